@@ -0,0 +1,128 @@
+package walrus
+
+import (
+	"sort"
+	"sync"
+)
+
+// One entry in a bucket's change log: a document mutation at a given
+// sequence. Deleted entries are kept (not just omitted) so a view can
+// retract a doc's previously emitted rows without needing to re-map it.
+type logEntry struct {
+	Seq     uint64
+	DocID   string
+	Deleted bool
+}
+
+// A sequence-ordered log of document changes for a bucket, analogous to
+// Sync Gateway's encoded channel change log. Views consult it via Since to
+// find only the docs that changed since they were last indexed, instead of
+// scanning every doc in the bucket on every updateView pass.
+type changeLog struct {
+	mutex    sync.Mutex
+	entries  []logEntry
+	baseline uint64 // the seq just before entries[0]; advanced by TruncateChangeLog
+}
+
+// Add appends a change to the log. Callers must supply increasing seqs.
+func (log *changeLog) Add(seq uint64, docid string, deleted bool) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.entries = append(log.entries, logEntry{seq, docid, deleted})
+}
+
+// Since returns the log entries with Seq > afterSeq, in seq order. The
+// second result is false if afterSeq predates the log's baseline, meaning
+// some changes in that range were already truncated away and the caller
+// must fall back to a full scan instead of trusting an incomplete list.
+func (log *changeLog) Since(afterSeq uint64) (entries []logEntry, ok bool) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if afterSeq < log.baseline {
+		return nil, false
+	}
+	i := sort.Search(len(log.entries), func(i int) bool {
+		return log.entries[i].Seq > afterSeq
+	})
+	entries = make([]logEntry, len(log.entries)-i)
+	copy(entries, log.entries[i:])
+	return entries, true
+}
+
+// TruncateChangeLog discards the oldest entries beyond maxLength, recording
+// the newest discarded seq as the log's new baseline -- the same role
+// TruncateEncodedChangeLog's removed-sequence baseline plays for channel
+// logs -- so a later Since() call for a seq older than that baseline
+// reports ok=false instead of silently returning a partial result.
+func (log *changeLog) TruncateChangeLog(maxLength int) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if len(log.entries) <= maxLength {
+		return
+	}
+	cut := len(log.entries) - maxLength
+	log.baseline = log.entries[cut-1].Seq
+	remaining := make([]logEntry, maxLength)
+	copy(remaining, log.entries[cut:])
+	log.entries = remaining
+}
+
+// changedDocs returns the docs that changed in (sinceSeq, toSeq], using the
+// bucket's change log. ok is false when the bucket has no change log yet,
+// or the log's tail was truncated past sinceSeq, in which case the caller
+// should fall back to scanning every doc in the bucket.
+//
+// changes *changeLog is a field this package expects on lolrus, declared in
+// the bucket-construction file (same one that owns DesignDocs/Docs/LastSeq/
+// lock) which isn't part of this change set.
+func (bucket *lolrus) changedDocs(sinceSeq, toSeq uint64) (changed []logEntry, ok bool) {
+	if bucket.changes == nil {
+		return nil, false
+	}
+	entries, ok := bucket.changes.Since(sinceSeq)
+	if !ok {
+		return nil, false
+	}
+	for _, entry := range entries {
+		if entry.Seq > toSeq {
+			break
+		}
+		changed = append(changed, entry)
+	}
+	return changed, true
+}
+
+// NotifyChange records a document mutation in the bucket's change log. The
+// doc-write path (Set/Add/Delete) should call this as its last step, so
+// later updateView passes -- on this view or any other view of the same
+// bucket -- can use changedDocs instead of a full scan.
+//
+// Explicitly descoped from this series: the original request also asked for
+// a background auto-updater goroutine per view, subscribed to a chan uint64
+// of sequences fed by NotifyChange, so View(..., stale=false) could return
+// immediately with a fresh result instead of blocking on a synchronous
+// re-map. That goroutine was written once (see the chunk0-4 history) but
+// nothing in this tree's doc-write path -- because no such path exists here;
+// Set/Add/Delete live in the bucket-construction file outside this change
+// set -- ever called NotifyChange to feed it, so it only ever leaked a
+// forever-blocked goroutine per view. It was removed rather than left in
+// place non-functional. stale=false still blocks on a synchronous
+// updateView pass that re-maps the docs changed since the view's last
+// indexed sequence; wiring the auto-updater back in is follow-up work that
+// belongs with whichever commit adds the real doc-write path.
+func (bucket *lolrus) NotifyChange(seq uint64, docid string, deleted bool) {
+	bucket.recordChange(seq, docid, deleted)
+}
+
+// recordChange appends to the bucket's change log, creating it on first
+// use. Besides NotifyChange, updateView itself calls this while falling
+// back to a full scan (e.g. because the log doesn't exist yet), so the log
+// gets populated from what's actually been observed even before any write
+// path calls NotifyChange: the feature degrades to "no better than a full
+// scan" rather than staying permanently empty.
+func (bucket *lolrus) recordChange(seq uint64, docid string, deleted bool) {
+	if bucket.changes == nil {
+		bucket.changes = &changeLog{}
+	}
+	bucket.changes.Add(seq, docid, deleted)
+}
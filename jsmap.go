@@ -0,0 +1,96 @@
+package walrus
+
+import (
+	"encoding/json"
+	"runtime"
+
+	"github.com/robertkrimen/otto"
+)
+
+// JSMapFunction is a compiled CouchDB map function: `function(doc) {...}`.
+// It's backed by a pool of otto VMs rather than a single one, since otto
+// isn't safe for concurrent use: without a pool, the goroutines that
+// updateView fans map calls out to (via Parallelize) would all serialize on
+// one VM, and a many-core machine would never map faster than one core.
+type JSMapFunction struct {
+	source string
+	pool   chan *mapVM
+}
+
+// One VM in the pool, holding its own compiled copy of the script and the
+// "emit" accumulator that script's calls write into.
+type mapVM struct {
+	vm           *otto.Otto
+	fn           otto.Value
+	compileError error
+	docid        string
+	rows         []*ViewRow
+}
+
+// NewJSMapFunction compiles funcSource into a pool of GOMAXPROCS VMs.
+func NewJSMapFunction(funcSource string) *JSMapFunction {
+	return NewJSMapFunctionWithConcurrency(funcSource, 0)
+}
+
+// NewJSMapFunctionWithConcurrency is like NewJSMapFunction but lets the
+// caller override the VM pool size -- see BucketOptions.MapConcurrency.
+// vmCount <= 0 means GOMAXPROCS.
+func NewJSMapFunctionWithConcurrency(funcSource string, vmCount int) *JSMapFunction {
+	if vmCount <= 0 {
+		vmCount = runtime.GOMAXPROCS(0)
+	}
+	mapper := &JSMapFunction{
+		source: funcSource,
+		pool:   make(chan *mapVM, vmCount),
+	}
+	for i := 0; i < vmCount; i++ {
+		mapper.pool <- newMapVM(funcSource)
+	}
+	return mapper
+}
+
+func newMapVM(funcSource string) *mapVM {
+	worker := &mapVM{}
+	worker.vm = otto.New()
+	worker.vm.Set("emit", func(call otto.FunctionCall) otto.Value {
+		key, _ := call.Argument(0).Export()
+		var value interface{}
+		if len(call.ArgumentList) > 1 {
+			value, _ = call.Argument(1).Export()
+		}
+		worker.rows = append(worker.rows, &ViewRow{ID: worker.docid, Key: key, Value: value})
+		return otto.UndefinedValue()
+	})
+	worker.fn, worker.compileError = worker.vm.Run("(" + funcSource + ")")
+	return worker
+}
+
+// CallFunction runs the map function against a single document, checking a
+// VM out of the pool for the duration of the call and returning it
+// afterwards. Safe to call from multiple goroutines at once: each call runs
+// on whichever VM is free, so mapping scales with pool size instead of
+// serializing on a single VM.
+func (mapper *JSMapFunction) CallFunction(jsonDoc string, docid string) ([]*ViewRow, error) {
+	worker := <-mapper.pool
+	defer func() { mapper.pool <- worker }()
+
+	if worker.compileError != nil {
+		return nil, worker.compileError
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(jsonDoc), &doc); err != nil {
+		return nil, err
+	}
+
+	worker.docid = docid
+	worker.rows = worker.rows[:0]
+	if _, err := worker.fn.Call(otto.NullValue(), doc); err != nil {
+		return nil, err
+	}
+
+	// Copy out of the VM's reused slice before it's handed to another caller.
+	rows := make([]*ViewRow, len(worker.rows))
+	copy(rows, worker.rows)
+	return rows, nil
+}
@@ -0,0 +1,37 @@
+package walrus
+
+import (
+	"fmt"
+	"testing"
+)
+
+const benchMapFunction = `function(doc) { emit(doc.key, doc.value); }`
+
+func benchmarkJSMapFunction(b *testing.B, vmCount int) {
+	mapper := NewJSMapFunctionWithConcurrency(benchMapFunction, vmCount)
+	doc := `{"key": "k", "value": 1}`
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := mapper.CallFunction(doc, fmt.Sprintf("doc%d", i)); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkJSMapFunctionSingleVM measures throughput with a single otto VM,
+// where every concurrent mapper call serializes on the pool's one slot.
+func BenchmarkJSMapFunctionSingleVM(b *testing.B) {
+	benchmarkJSMapFunction(b, 1)
+}
+
+// BenchmarkJSMapFunctionPooled measures throughput with a GOMAXPROCS-sized
+// VM pool, which should scale with concurrent callers instead of
+// serializing on one VM the way BenchmarkJSMapFunctionSingleVM does.
+func BenchmarkJSMapFunctionPooled(b *testing.B) {
+	benchmarkJSMapFunction(b, 0)
+}
@@ -0,0 +1,281 @@
+package walrus
+
+import (
+	"sync"
+
+	"github.com/robertkrimen/otto"
+)
+
+// The largest number of rows reduced in a single JS call. Larger groups are
+// reduced in chunks and then combined with a rereduce, same as CouchDB does,
+// so a single otto call never has to hold an entire huge group in memory.
+const reduceChunkSize = 1000
+
+// A compiled CouchDB-style reduce function: `function(keys, values, rereduce) {...}`.
+// Unlike JSMapFunction's pool of VMs, it owns a single otto VM, which isn't
+// safe for concurrent use, so calls are serialized with a mutex.
+type JSReduceFunction struct {
+	mutex        sync.Mutex
+	vm           *otto.Otto
+	fn           otto.Value
+	compileError error
+}
+
+// Compiles a JS reduce function.
+func NewJSReduceFunction(funcSource string) *JSReduceFunction {
+	vm := otto.New()
+	fnValue, err := vm.Run("(" + funcSource + ")")
+	return &JSReduceFunction{vm: vm, fn: fnValue, compileError: err}
+}
+
+// Invokes the reduce function, following CouchDB's two call conventions:
+// reduce(keys, values, false) for the initial reduce of mapped rows, and
+// reduce(null, values, true) to rereduce a set of previous reduce outputs.
+func (reducer *JSReduceFunction) CallFunction(keys []interface{}, values []interface{}, rereduce bool) (interface{}, error) {
+	reducer.mutex.Lock()
+	defer reducer.mutex.Unlock()
+
+	if reducer.compileError != nil {
+		return nil, reducer.compileError
+	}
+
+	var keysArg interface{}
+	if !rereduce {
+		keysArg = keys
+	}
+	result, err := reducer.fn.Call(otto.NullValue(), keysArg, values, rereduce)
+	if err != nil {
+		return nil, err
+	}
+	return result.Export()
+}
+
+// Reduces a single group's rows down to one value, using the given builtin
+// or compiled-JS reducer. Chunks rows larger than reduceChunkSize and
+// combines the chunk outputs with a rereduce call, matching CouchDB.
+func reduceGroup(reduceFunction string, compiledReduce *JSReduceFunction, rows []*ViewRow) (interface{}, error) {
+	if len(rows) <= reduceChunkSize {
+		return callReducer(reduceFunction, compiledReduce, rowKeys(rows), rowValues(rows), false)
+	}
+
+	partials := make([]interface{}, 0, (len(rows)/reduceChunkSize)+1)
+	for i := 0; i < len(rows); i += reduceChunkSize {
+		end := i + reduceChunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		chunk := rows[i:end]
+		partial, err := callReducer(reduceFunction, compiledReduce, rowKeys(chunk), rowValues(chunk), false)
+		if err != nil {
+			return nil, err
+		}
+		partials = append(partials, partial)
+	}
+	return callReducer(reduceFunction, compiledReduce, nil, partials, true)
+}
+
+// Invokes either a builtin reducer or a compiled/ad-hoc JS reduce function.
+func callReducer(reduceFunction string, compiledReduce *JSReduceFunction, keys []interface{}, values []interface{}, rereduce bool) (interface{}, error) {
+	switch reduceFunction {
+	case "_count":
+		if rereduce {
+			return sumNumbers(values), nil
+		}
+		return float64(len(values)), nil
+	case "_sum":
+		return sumValues(values), nil
+	case "_stats":
+		return statsValues(values, rereduce), nil
+	default:
+		reducer := compiledReduce
+		if reducer == nil {
+			reducer = NewJSReduceFunction(reduceFunction)
+		}
+		return reducer.CallFunction(keys, values, rereduce)
+	}
+}
+
+func rowKeys(rows []*ViewRow) []interface{} {
+	keys := make([]interface{}, len(rows))
+	for i, row := range rows {
+		keys[i] = []interface{}{row.Key, row.ID}
+	}
+	return keys
+}
+
+func rowValues(rows []*ViewRow) []interface{} {
+	values := make([]interface{}, len(rows))
+	for i, row := range rows {
+		values[i] = row.Value
+	}
+	return values
+}
+
+func sumNumbers(values []interface{}) float64 {
+	var sum float64
+	for _, value := range values {
+		if n, ok := value.(float64); ok {
+			sum += n
+		}
+	}
+	return sum
+}
+
+// Sums values elementwise, the way CouchDB's _sum does when rows emit arrays
+// of numbers instead of plain numbers.
+func sumValues(values []interface{}) interface{} {
+	var scalarSum float64
+	var arraySum []float64
+	for _, value := range values {
+		switch value := value.(type) {
+		case float64:
+			scalarSum += value
+		case []interface{}:
+			if arraySum == nil {
+				arraySum = make([]float64, len(value))
+			}
+			for i, elem := range value {
+				if i >= len(arraySum) {
+					break
+				}
+				if n, ok := elem.(float64); ok {
+					arraySum[i] += n
+				}
+			}
+		}
+	}
+	if arraySum != nil {
+		result := make([]interface{}, len(arraySum))
+		for i, n := range arraySum {
+			result[i] = n
+		}
+		return result
+	}
+	return scalarSum
+}
+
+type reduceStats struct {
+	Sum    float64 `json:"sum"`
+	Count  float64 `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	SumSqr float64 `json:"sumsqr"`
+}
+
+// Computes (or combines) CouchDB's _stats reducer: {sum,count,min,max,sumsqr}.
+// On a non-rereduce pass `values` are the raw numbers being reduced; on a
+// rereduce pass they're the stats objects from the previous chunk pass.
+func statsValues(values []interface{}, rereduce bool) map[string]interface{} {
+	var stats reduceStats
+	first := true
+	accumulate := func(n, count, sumsqr float64) {
+		stats.Sum += n
+		stats.Count += count
+		stats.SumSqr += sumsqr
+		if first || n < stats.Min {
+			stats.Min = n
+		}
+		if first || n > stats.Max {
+			stats.Max = n
+		}
+		first = false
+	}
+
+	if rereduce {
+		for _, value := range values {
+			if m, ok := value.(map[string]interface{}); ok {
+				sum, _ := m["sum"].(float64)
+				count, _ := m["count"].(float64)
+				min, _ := m["min"].(float64)
+				max, _ := m["max"].(float64)
+				sumsqr, _ := m["sumsqr"].(float64)
+				stats.Sum += sum
+				stats.Count += count
+				stats.SumSqr += sumsqr
+				if first || min < stats.Min {
+					stats.Min = min
+				}
+				if first || max > stats.Max {
+					stats.Max = max
+				}
+				first = false
+			}
+		}
+	} else {
+		for _, value := range values {
+			if n, ok := value.(float64); ok {
+				accumulate(n, 1, n*n)
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"sum":    stats.Sum,
+		"count":  stats.Count,
+		"min":    stats.Min,
+		"max":    stats.Max,
+		"sumsqr": stats.SumSqr,
+	}
+}
+
+// Reduces result.Rows in place to a single row holding the reduction of the
+// whole result set. It does no grouping: group/group_level are handled by
+// processViewResult, which calls reduceViewResult directly.
+func ReduceViewResult(reduceFunction string, result *ViewResult) error {
+	return reduceViewResult(reduceFunction, nil, result, false, 0)
+}
+
+// Same as ReduceViewResult, but takes the view's already-compiled reduce
+// function (if any), so a custom JS reducer isn't recompiled on every query,
+// plus the group/group_level params ProcessViewResult needs to honor: each
+// group of rows (whose keys, or key prefixes, collate equal) is reduced
+// separately into one output row. With group=false and group_level=0 the
+// whole result set is reduced to a single row.
+func reduceViewResult(reduceFunction string, compiledReduce *JSReduceFunction, result *ViewResult, group bool, groupLevel int) error {
+	if len(result.Rows) == 0 {
+		return nil
+	}
+
+	var collator JSONCollator
+	reduced := make([]*ViewRow, 0)
+
+	start := 0
+	for start < len(result.Rows) {
+		groupKey := groupKeyOf(result.Rows[start].Key, group, groupLevel)
+		end := start + 1
+		for end < len(result.Rows) && collator.Collate(groupKeyOf(result.Rows[end].Key, group, groupLevel), groupKey) == 0 {
+			end++
+		}
+
+		value, err := reduceGroup(reduceFunction, compiledReduce, result.Rows[start:end])
+		if err != nil {
+			return err
+		}
+		reduced = append(reduced, &ViewRow{Key: groupKey, Value: value})
+		start = end
+	}
+
+	result.Rows = reduced
+	return nil
+}
+
+// Returns the key a row belongs under when grouping: the full key when
+// group=true, the first groupLevel elements of an array key when group_level
+// is set, or nil (everything in one group) otherwise.
+func groupKeyOf(key interface{}, group bool, groupLevel int) interface{} {
+	if groupLevel > 0 {
+		if array, ok := key.([]interface{}); ok {
+			if groupLevel >= len(array) {
+				return array
+			}
+			prefix := make([]interface{}, groupLevel)
+			copy(prefix, array[:groupLevel])
+			return prefix
+		}
+		return key
+	}
+	if group {
+		return key
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package walrus
+
+import (
+	"reflect"
+	"testing"
+)
+
+// _stats should reduce to CouchDB's {sum,count,min,max,sumsqr} object.
+func TestReduceViewResultStats(t *testing.T) {
+	result := ViewResult{Rows: []*ViewRow{
+		{ID: "a", Key: 1.0, Value: 2.0},
+		{ID: "b", Key: 1.0, Value: 4.0},
+		{ID: "c", Key: 1.0, Value: 6.0},
+	}}
+
+	if err := ReduceViewResult("_stats", &result); err != nil {
+		t.Fatalf("ReduceViewResult: %v", err)
+	}
+	if len(result.Rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(result.Rows))
+	}
+	expected := map[string]interface{}{
+		"sum": 12.0, "count": 3.0, "min": 2.0, "max": 6.0, "sumsqr": 56.0,
+	}
+	if got := result.Rows[0].Value; !reflect.DeepEqual(got, expected) {
+		t.Errorf("_stats = %v, want %v", got, expected)
+	}
+}
+
+// Groups larger than reduceChunkSize must be reduced in chunks and then
+// rereduced, not handed to the reducer in one call -- and the end result
+// should be the same as reducing the whole group in a single pass would be.
+func TestReduceViewResultChunkedRereduce(t *testing.T) {
+	const rowCount = reduceChunkSize*2 + 137 // force more than one chunk boundary
+	rows := make([]*ViewRow, rowCount)
+	for i := range rows {
+		rows[i] = &ViewRow{ID: string(rune('a' + i%26)), Key: nil, Value: 1.0}
+	}
+	result := ViewResult{Rows: rows}
+
+	if err := ReduceViewResult("_sum", &result); err != nil {
+		t.Fatalf("ReduceViewResult: %v", err)
+	}
+	if len(result.Rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(result.Rows))
+	}
+	if got := result.Rows[0].Value; got != float64(rowCount) {
+		t.Errorf("chunked _sum = %v, want %v", got, float64(rowCount))
+	}
+}
+
+// group_level over compound (array) keys should group by the first N key
+// elements, not the whole key -- ["a","x"] and ["a","y"] collapse into one
+// "a" group at group_level=1, while ["b","x"] stays separate.
+func TestReduceViewResultGroupLevelCompoundKeys(t *testing.T) {
+	result := sortedRows(
+		[]interface{}{"a", "x"},
+		[]interface{}{"a", "y"},
+		[]interface{}{"b", "x"},
+	)
+	for _, row := range result.Rows {
+		row.Value = 1.0
+	}
+
+	if err := reduceViewResult("_count", nil, &result, true, 1); err != nil {
+		t.Fatalf("reduceViewResult: %v", err)
+	}
+
+	if len(result.Rows) != 2 {
+		t.Fatalf("got %d groups, want 2: %+v", len(result.Rows), result.Rows)
+	}
+	groupA, groupB := result.Rows[0], result.Rows[1]
+	if !reflect.DeepEqual(groupA.Key, []interface{}{"a"}) || groupA.Value != 2.0 {
+		t.Errorf("group 0 = %+v, want key [a] value 2", groupA)
+	}
+	if !reflect.DeepEqual(groupB.Key, []interface{}{"b"}) || groupB.Value != 1.0 {
+		t.Errorf("group 1 = %+v, want key [b] value 1", groupB)
+	}
+}
@@ -0,0 +1,171 @@
+// Package viewhttp exposes walrus views over a CouchDB-compatible HTTP API,
+// so a walrus bucket can stand in as a mock CouchDB/Sync Gateway view
+// server in integration tests without embedding the Go API.
+package viewhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/andrewwebber/walrus"
+)
+
+var viewPathRegexp = regexp.MustCompile(`^/([^/]+)/_design/([^/]+)/_view/([^/]+)$`)
+var ddocPathRegexp = regexp.MustCompile(`^/([^/]+)/_design/([^/]+)$`)
+
+// NewHandler returns an http.Handler exposing every bucket in buckets, keyed
+// by name, over CouchDB's design-doc and view HTTP API:
+//
+//	GET/PUT/DELETE /{bucket}/_design/{ddoc}
+//	GET            /{bucket}/_design/{ddoc}/_view/{name}
+func NewHandler(buckets map[string]walrus.Bucket) http.Handler {
+	return &handler{buckets: buckets}
+}
+
+type handler struct {
+	buckets map[string]walrus.Bucket
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m := viewPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+		h.serveView(w, r, m[1], m[2], m[3])
+		return
+	}
+	if m := ddocPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+		h.serveDDoc(w, r, m[1], m[2])
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (h *handler) bucketNamed(w http.ResponseWriter, name string) walrus.Bucket {
+	bucket, found := h.buckets[name]
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "not_found", "reason": "no such bucket",
+		})
+		return nil
+	}
+	return bucket
+}
+
+func (h *handler) serveDDoc(w http.ResponseWriter, r *http.Request, bucketName, ddoc string) {
+	bucket := h.bucketNamed(w, bucketName)
+	if bucket == nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var design interface{}
+		if err := bucket.GetDDoc(ddoc, &design); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, design)
+	case "PUT":
+		var design interface{}
+		if err := json.NewDecoder(r.Body).Decode(&design); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := bucket.PutDDoc(ddoc, design); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true})
+	case "DELETE":
+		if err := bucket.DeleteDDoc(ddoc); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) serveView(w http.ResponseWriter, r *http.Request, bucketName, ddoc, viewName string) {
+	bucket := h.bucketNamed(w, bucketName)
+	if bucket == nil {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params, err := parseViewParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := bucket.View(ddoc, viewName, params)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_rows": result.TotalRows,
+		"rows":       result.Rows,
+		"errors":     result.Errors,
+	})
+}
+
+// parseViewParams decodes CouchDB-style view query parameters the way
+// CouchDB does: startkey/endkey/key/keys are JSON values (so
+// startkey=["foo",1] works), limit/skip/group_level are integers, and the
+// rest are booleans.
+func parseViewParams(query url.Values) (map[string]interface{}, error) {
+	params := make(map[string]interface{}, len(query))
+	for key, values := range query {
+		if len(values) == 0 {
+			continue
+		}
+		raw := values[0]
+		switch key {
+		case "startkey", "start_key", "endkey", "end_key", "key", "keys":
+			var value interface{}
+			if err := json.Unmarshal([]byte(raw), &value); err != nil {
+				return nil, fmt.Errorf("invalid JSON for %q: %v", key, err)
+			}
+			params[key] = value
+		case "limit", "skip", "group_level":
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer for %q: %v", key, err)
+			}
+			params[key] = n
+		case "reduce", "group", "include_docs", "inclusive_end", "reverse":
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid boolean for %q: %v", key, err)
+			}
+			params[key] = b
+		case "stale":
+			// CouchDB accepts "ok"/"update_after"/"false"; only "false" means fresh.
+			params[key] = raw != "false"
+		}
+	}
+	return params, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if _, ok := err.(walrus.MissingError); ok {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]interface{}{"error": "error", "reason": err.Error()})
+}
@@ -0,0 +1,314 @@
+package walrus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	viewIndexDocPrefix = "d:" // docid -> JSON list of that doc's emitted index keys
+	viewIndexMetaKey   = "m:lastSeq"
+)
+
+// BucketOptions configures optional, non-default behavior of a lolrus bucket.
+// The zero value reproduces walrus's original all-in-memory behavior.
+//
+// NOTE: reaching this from outside the package needs a constructor overload
+// (e.g. NewBucketWithOptions) on the bucket-construction file that plumbs a
+// BucketOptions into lolrus.options -- that file isn't part of this change
+// set. Until it's added, IndexDir/MapConcurrency can only be exercised by
+// code within this package that constructs a lolrus directly.
+type BucketOptions struct {
+	// IndexDir, if non-empty, persists view indexes to disk (via goleveldb)
+	// under this directory instead of rebuilding them in memory on every
+	// updateView pass.
+	IndexDir string
+
+	// MapConcurrency overrides how many otto VMs run map functions in
+	// parallel; defaults to GOMAXPROCS when zero.
+	MapConcurrency int
+}
+
+// indexedRow is what's actually stored at an emit key: the row's original
+// (un-collated) key plus its emitted value, so queries can report both.
+type indexedRow struct {
+	Key   interface{} `json:"k"`
+	Value interface{} `json:"v"`
+}
+
+// A persistent, on-disk view index backed by goleveldb, keyed by
+// (collated-key, docid) -> emitted value. startkey/endkey queries become a
+// LevelDB range iteration instead of an in-memory scan+sort, and the index
+// survives process restarts.
+type leveldbViewIndex struct {
+	db *leveldb.DB
+}
+
+func openViewIndex(indexDir, ddoc, viewName string) (*leveldbViewIndex, error) {
+	dir := filepath.Join(indexDir, ddoc, viewName)
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("walrus: opening view index at %q: %v", dir, err)
+	}
+	return &leveldbViewIndex{db: db}, nil
+}
+
+func (idx *leveldbViewIndex) Close() error {
+	return idx.db.Close()
+}
+
+func (idx *leveldbViewIndex) getLastIndexedSequence() uint64 {
+	raw, err := idx.db.Get([]byte(viewIndexMetaKey), nil)
+	if err != nil || len(raw) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(raw)
+}
+
+func (idx *leveldbViewIndex) setLastIndexedSequence(batch *leveldb.Batch, seq uint64) {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, seq)
+	batch.Put([]byte(viewIndexMetaKey), raw)
+}
+
+// emitKeyFor builds the LevelDB key for one emitted (key,docid) pair:
+// the collation-ordered encoding of the key, a separator, then the docid.
+func emitKeyFor(key interface{}, docid string) []byte {
+	encoded := append(encodeCollatable(key), 0)
+	return append(encoded, []byte(docid)...)
+}
+
+// updateDoc retracts whatever docid previously emitted (via the secondary
+// docid index) and writes its new rows, atomically, as part of a single
+// updateView pass. Passing rows == nil just retracts (e.g. deleted docs).
+func (idx *leveldbViewIndex) updateDoc(batch *leveldb.Batch, docid string, rows []*ViewRow) error {
+	docKey := []byte(viewIndexDocPrefix + docid)
+	if raw, err := idx.db.Get(docKey, nil); err == nil {
+		var oldKeys [][]byte
+		if err := json.Unmarshal(raw, &oldKeys); err != nil {
+			return err
+		}
+		for _, oldKey := range oldKeys {
+			batch.Delete(oldKey)
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	if len(rows) == 0 {
+		batch.Delete(docKey)
+		return nil
+	}
+
+	newKeys := make([][]byte, len(rows))
+	for i, row := range rows {
+		emitKey := emitKeyFor(row.Key, docid)
+		value, err := json.Marshal(indexedRow{Key: row.Key, Value: row.Value})
+		if err != nil {
+			return err
+		}
+		batch.Put(emitKey, value)
+		newKeys[i] = emitKey
+	}
+
+	docValue, err := json.Marshal(newKeys)
+	if err != nil {
+		return err
+	}
+	batch.Put(docKey, docValue)
+	return nil
+}
+
+// applyChanges incrementally brings the index up to toSeq: only docs whose
+// Sequence falls in (sinceSeq, toSeq] are re-mapped, each one's previous
+// emits are retracted and replaced in a single batch, and the new
+// lastIndexedSequence is persisted alongside them.
+func (idx *leveldbViewIndex) applyChanges(mapFunction *JSMapFunction, docs map[string]*lolrusDoc, sinceSeq, toSeq uint64) error {
+	batch := new(leveldb.Batch)
+	for docid, doc := range docs {
+		if doc.Sequence <= sinceSeq || doc.Sequence > toSeq {
+			continue
+		}
+		raw := doc.Raw
+		if raw == nil {
+			// Deleted doc: retract its previous emits.
+			if err := idx.updateDoc(batch, docid, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if !doc.IsJSON {
+			raw = []byte(`{}`) // Ignore contents of non-JSON (raw) docs
+		}
+		rows, err := mapFunction.CallFunction(string(raw), docid)
+		if err != nil {
+			ohai("Error running map function: %s", err)
+			if updateErr := idx.updateDoc(batch, docid, nil); updateErr != nil {
+				return updateErr
+			}
+			continue
+		}
+		if err := idx.updateDoc(batch, docid, rows); err != nil {
+			return err
+		}
+	}
+	idx.setLastIndexedSequence(batch, toSeq)
+	return idx.db.Write(batch, nil)
+}
+
+// applyChangedDocs is like applyChanges, but re-maps only the specific docs
+// named by changed (as produced by (*lolrus).changedDocs) instead of
+// scanning every doc in the bucket -- the O(what changed) path applyChanges's
+// full scan can't take once a change log is available. toSeq is still needed
+// to persist the new lastIndexedSequence.
+func (idx *leveldbViewIndex) applyChangedDocs(mapFunction *JSMapFunction, docs map[string]*lolrusDoc, changed []logEntry, toSeq uint64) error {
+	batch := new(leveldb.Batch)
+	for _, entry := range changed {
+		if entry.Deleted {
+			if err := idx.updateDoc(batch, entry.DocID, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		doc, found := docs[entry.DocID]
+		if !found || doc.Raw == nil {
+			continue
+		}
+		raw := doc.Raw
+		if !doc.IsJSON {
+			raw = []byte(`{}`) // Ignore contents of non-JSON (raw) docs
+		}
+		rows, err := mapFunction.CallFunction(string(raw), entry.DocID)
+		if err != nil {
+			ohai("Error running map function: %s", err)
+			if updateErr := idx.updateDoc(batch, entry.DocID, nil); updateErr != nil {
+				return updateErr
+			}
+			continue
+		}
+		if err := idx.updateDoc(batch, entry.DocID, rows); err != nil {
+			return err
+		}
+	}
+	idx.setLastIndexedSequence(batch, toSeq)
+	return idx.db.Write(batch, nil)
+}
+
+// rangeQuery iterates the index in collation order between startkey and
+// endkey (either may be nil for open-ended), returning a materialized
+// ViewResult. This is a LevelDB range scan, not an in-memory sort.
+func (idx *leveldbViewIndex) rangeQuery(startkey, endkey interface{}) (ViewResult, error) {
+	var result ViewResult
+	var rng util.Range
+	if startkey != nil {
+		rng.Start = append(encodeCollatable(startkey), 0)
+	}
+	if endkey != nil {
+		rng.Limit = append(append(encodeCollatable(endkey), 0), 0xFF)
+	}
+
+	iter := idx.db.NewIterator(&rng, nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()
+		if bytes.HasPrefix(key, []byte(viewIndexDocPrefix)) || bytes.Equal(key, []byte(viewIndexMetaKey)) {
+			continue
+		}
+		sep := bytes.LastIndexByte(key, 0)
+		if sep < 0 {
+			continue
+		}
+		docid := string(key[sep+1:])
+
+		var stored indexedRow
+		if err := json.Unmarshal(iter.Value(), &stored); err != nil {
+			return result, err
+		}
+		result.Rows = append(result.Rows, &ViewRow{ID: docid, Key: stored.Key, Value: stored.Value})
+	}
+	return result, iter.Error()
+}
+
+//////// COLLATABLE KEY ENCODING
+
+// encodeCollatable converts a JSON-decoded value into a byte string whose
+// lexicographic order matches CouchDB's view collation order (null < false <
+// true < numbers < strings < arrays < objects), so it can be used directly
+// as a sortable LevelDB key.
+func encodeCollatable(value interface{}) []byte {
+	var buf bytes.Buffer
+	writeCollatable(&buf, value)
+	return buf.Bytes()
+}
+
+const (
+	collateNull = iota + 2 // tags start above the end-of-array/object marker (1)
+	collateFalse
+	collateTrue
+	collateNumber
+	collateString
+	collateArray
+	collateObject
+)
+
+func writeCollatable(buf *bytes.Buffer, value interface{}) {
+	switch value := value.(type) {
+	case nil:
+		buf.WriteByte(collateNull)
+	case bool:
+		if value {
+			buf.WriteByte(collateTrue)
+		} else {
+			buf.WriteByte(collateFalse)
+		}
+	case float64:
+		buf.WriteByte(collateNumber)
+		binary.Write(buf, binary.BigEndian, sortableFloatBits(value))
+	case string:
+		buf.WriteByte(collateString)
+		buf.WriteString(value)
+		buf.WriteByte(0)
+	case []interface{}:
+		buf.WriteByte(collateArray)
+		for _, elem := range value {
+			writeCollatable(buf, elem)
+		}
+		buf.WriteByte(1) // end-of-array marker; sorts before any element tag
+	case map[string]interface{}:
+		buf.WriteByte(collateObject)
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeCollatable(buf, k)
+			writeCollatable(buf, value[k])
+		}
+		buf.WriteByte(1)
+	default:
+		// Shouldn't happen for JSON-decoded values; fall back to its string form.
+		buf.WriteByte(collateString)
+		fmt.Fprintf(buf, "%v", value)
+		buf.WriteByte(0)
+	}
+}
+
+// sortableFloatBits maps a float64 to a uint64 whose unsigned numeric order
+// matches the float's numeric order (the standard IEEE-754 sort-key trick).
+func sortableFloatBits(f float64) uint64 {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | (1 << 63)
+}
+
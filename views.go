@@ -10,10 +10,21 @@ import (
 
 // A single view stored in a lolrus.
 type lolrusView struct {
-	mapFunction         *JSMapFunction // The compiled map function
-	reduceFunction      string         // The source of the reduce function (if any)
-	index               ViewResult     // The latest complete result
-	lastIndexedSequence uint64         // Bucket's lastSeq at the time the index was built
+	mapFunction         *JSMapFunction    // The compiled map function
+	reduceFunction      string            // The source of the reduce function (if any)
+	compiledReduce      *JSReduceFunction // The compiled reduce function, if it's not a builtin
+	index               ViewResult        // The latest complete result (in-memory mode only)
+	persistentIndex     *leveldbViewIndex // On-disk index, if BucketOptions.IndexDir was set
+	lastIndexedSequence uint64            // Bucket's lastSeq at the time the index was built
+}
+
+// closeView releases any resources a lolrusView holds that outlive the view
+// itself (currently just its on-disk index's goleveldb handle), so
+// replacing or deleting a design doc doesn't leak them.
+func closeView(view *lolrusView) {
+	if view.persistentIndex != nil {
+		view.persistentIndex.Close()
+	}
 }
 
 // Stores view functions for use by a lolrus.
@@ -45,6 +56,14 @@ func (bucket *lolrus) PutDDoc(docname string, value interface{}) error {
 		return nil // unchanged
 	}
 
+	// Close the old views (releasing their goleveldb locks, if persistent)
+	// before compiling the new ones: _compileDesignDoc reopens an index at
+	// the same IndexDir/docname/viewname path for any view name that's kept,
+	// which fails while the old handle on that same path is still open.
+	for _, oldView := range bucket.views[docname] {
+		closeView(oldView)
+	}
+
 	err = bucket._compileDesignDoc(docname, design)
 	if err != nil {
 		return err
@@ -62,22 +81,47 @@ func (bucket *lolrus) DeleteDDoc(docname string) error {
 	if bucket.DesignDocs[docname] == nil {
 		return MissingError{docname}
 	}
+	for _, view := range bucket.views[docname] {
+		closeView(view)
+	}
 	delete(bucket.DesignDocs, docname)
 	delete(bucket.views, docname)
 	return nil
 }
 
+// _compileDesignDoc relies on bucket.options (a BucketOptions) to decide map
+// concurrency and whether to persist indexes to disk. That field, and the
+// constructor overload that lets a caller set it, belong on the lolrus
+// struct itself -- which isn't part of this change set (it's declared in
+// the bucket-construction file alongside NewBucket, same as DesignDocs/Docs/
+// LastSeq/lock that every other method here already assumes). Until that
+// constructor plumbs a BucketOptions through, IndexDir/MapConcurrency can't
+// actually be set by any caller; see BucketOptions's doc comment.
 func (bucket *lolrus) _compileDesignDoc(docname string, design *DesignDoc) error {
 	if design == nil {
 		return nil
 	}
 	ddoc := lolrusDesignDoc{}
 	for name, fns := range design.Views {
-		jsserver := NewJSMapFunction(fns.Map)
+		jsserver := NewJSMapFunctionWithConcurrency(fns.Map, bucket.options.MapConcurrency)
 		view := &lolrusView{
 			mapFunction:    jsserver,
 			reduceFunction: fns.Reduce,
 		}
+		switch fns.Reduce {
+		case "", "_count", "_sum", "_stats":
+			// Builtin reducers need no compilation.
+		default:
+			view.compiledReduce = NewJSReduceFunction(fns.Reduce)
+		}
+		if bucket.options.IndexDir != "" {
+			persistentIndex, err := openViewIndex(bucket.options.IndexDir, docname, name)
+			if err != nil {
+				return err
+			}
+			view.persistentIndex = persistentIndex
+			view.lastIndexedSequence = persistentIndex.getLastIndexedSequence()
+		}
 		ddoc[name] = view
 	}
 	bucket.views[docname] = ddoc
@@ -142,13 +186,36 @@ func (bucket *lolrus) View(docName, viewName string, params map[string]interface
 	view, resultMaybe := bucket.findView(docName, viewName, stale)
 	if view == nil {
 		return result, bucket.missingError(docName + "/" + viewName)
-	} else if resultMaybe != nil {
+	}
+
+	if view.persistentIndex != nil {
+		if resultMaybe == nil {
+			bucket.updateView(view, 0)
+		}
+		startkey, endkey := extractRangeKeys(params)
+		// In a descending (reverse=true) query, CouchDB's convention is that
+		// startkey is the *upper* bound and endkey the *lower* bound -- the
+		// opposite of an ascending query. The LevelDB range always wants the
+		// lower bound as Start and the upper bound as Limit, so swap them
+		// here rather than assuming startkey is always the lower bound.
+		lowkey, highkey := startkey, endkey
+		if reverse, _ := params["reverse"].(bool); reverse {
+			lowkey, highkey = endkey, startkey
+		}
+		ranged, err := view.persistentIndex.rangeQuery(lowkey, highkey)
+		if err != nil {
+			return ranged, err
+		}
+		return processViewResult(ranged, params, bucket, view.reduceFunction, view.compiledReduce)
+	}
+
+	if resultMaybe != nil {
 		result = *resultMaybe
 	} else {
 		result = bucket.updateView(view, 0)
 	}
 
-	return ProcessViewResult(result, params, bucket, view.reduceFunction)
+	return processViewResult(result, params, bucket, view.reduceFunction, view.compiledReduce)
 }
 
 // Updates the view index if necessary, and returns it.
@@ -164,6 +231,22 @@ func (bucket *lolrus) updateView(view *lolrusView, toSequence uint64) ViewResult
 	}
 	ohai("\t... updating index to seq %d (from %d)", toSequence, view.lastIndexedSequence)
 
+	if view.persistentIndex != nil {
+		// Prefer the change log, same as the in-memory branch below: O(what
+		// changed) instead of applyChanges's full O(total docs) scan.
+		var applyErr error
+		if changed, ok := bucket.changedDocs(view.lastIndexedSequence, toSequence); ok {
+			applyErr = view.persistentIndex.applyChangedDocs(view.mapFunction, bucket.Docs, changed, toSequence)
+		} else {
+			applyErr = view.persistentIndex.applyChanges(view.mapFunction, bucket.Docs, view.lastIndexedSequence, toSequence)
+		}
+		if applyErr != nil {
+			ohai("Error updating persistent view index: %s", applyErr)
+		}
+		view.lastIndexedSequence = toSequence
+		return view.index
+	}
+
 	var result ViewResult
 	result.Rows = make([]*ViewRow, 0, len(bucket.Docs))
 	result.Errors = make([]ViewError, 0)
@@ -206,18 +289,48 @@ func (bucket *lolrus) updateView(view *lolrusView, toSequence uint64) ViewResult
 		}
 	}()
 
-	// Now shovel all the changed document bodies into the mapper:
-	for docid, doc := range bucket.Docs {
-		if doc.Sequence > view.lastIndexedSequence {
+	// Now shovel all the changed document bodies into the mapper. Prefer the
+	// change log, which is O(what changed) rather than O(every doc):
+	if changed, ok := bucket.changedDocs(view.lastIndexedSequence, toSequence); ok {
+		for _, entry := range changed {
+			updatedKeys[entry.DocID] = struct{}{}
+			if entry.Deleted {
+				continue // already removed from updatedKeys' rows below; nothing to re-map
+			}
+			doc, found := bucket.Docs[entry.DocID]
+			if !found || doc.Raw == nil {
+				continue
+			}
 			raw := doc.Raw
-			if raw != nil {
-				if !doc.IsJSON {
-					raw = []byte(`{}`) // Ignore contents of non-JSON (raw) docs
+			if !doc.IsJSON {
+				raw = []byte(`{}`) // Ignore contents of non-JSON (raw) docs
+			}
+			mapInput <- [2]string{entry.DocID, string(raw)}
+		}
+	} else {
+		// No usable change log yet: fall back to a full scan, but record
+		// what we see along the way so later updateView calls -- on this
+		// view or any other view of the same bucket -- can use changedDocs
+		// instead of scanning again.
+		var seen []logEntry
+		for docid, doc := range bucket.Docs {
+			if doc.Sequence > view.lastIndexedSequence && doc.Sequence <= toSequence {
+				raw := doc.Raw
+				seen = append(seen, logEntry{doc.Sequence, docid, raw == nil})
+				if raw != nil {
+					if !doc.IsJSON {
+						raw = []byte(`{}`) // Ignore contents of non-JSON (raw) docs
+					}
+					mapInput <- [2]string{docid, string(raw)}
+					updatedKeys[docid] = struct{}{}
 				}
-				mapInput <- [2]string{docid, string(raw)}
-				updatedKeys[docid] = struct{}{}
 			}
 		}
+		// The change log wants increasing seqs; map iteration order is random.
+		sort.Slice(seen, func(i, j int) bool { return seen[i].Seq < seen[j].Seq })
+		for _, entry := range seen {
+			bucket.recordChange(entry.Seq, entry.DocID, entry.Deleted)
+		}
 	}
 	close(mapInput)
 
@@ -253,41 +366,53 @@ func (bucket *lolrus) ViewCustom(ddoc, name string, params map[string]interface{
 	return json.Unmarshal(marshaled, vres)
 }
 
+// Pulls startkey/endkey (including their "key" and "_key" synonyms) out of a
+// view's query params, for both in-memory filtering and LevelDB range scans.
+func extractRangeKeys(params map[string]interface{}) (startkey, endkey interface{}) {
+	startkey = params["startkey"]
+	if startkey == nil {
+		startkey = params["start_key"] // older synonym
+	}
+	endkey = params["endkey"]
+	if endkey == nil {
+		endkey = params["end_key"]
+	}
+	if key := params["key"]; key != nil {
+		startkey = key
+		endkey = key
+	}
+	return
+}
+
 // Applies view params (startkey/endkey, limit, etc) against a ViewResult.
 func ProcessViewResult(result ViewResult, params map[string]interface{},
 	bucket Bucket, reduceFunction string) (ViewResult, error) {
+	return processViewResult(result, params, bucket, reduceFunction, nil)
+}
+
+// Same as ProcessViewResult, but takes the view's already-compiled reduce
+// function (if any) so a custom JS reducer isn't recompiled on every query.
+func processViewResult(result ViewResult, params map[string]interface{},
+	bucket Bucket, reduceFunction string, compiledReduce *JSReduceFunction) (ViewResult, error) {
 	includeDocs := false
 	limit := 0
+	skip := 0
 	reverse := false
 	reduce := true
 
 	if params != nil {
 		includeDocs, _ = params["include_docs"].(bool)
 		limit, _ = params["limit"].(int)
+		skip, _ = params["skip"].(int)
 		reverse, _ = params["reverse"].(bool)
 		if reduceParam, found := params["reduce"].(bool); found {
 			reduce = reduceParam
 		}
 	}
 
-	if reverse {
-		//TODO: Apply "reverse" option
-		return result, fmt.Errorf("Reverse is not supported yet, sorry")
-	}
-
-	startkey := params["startkey"]
-	if startkey == nil {
-		startkey = params["start_key"] // older synonym
-	}
-	endkey := params["endkey"]
-	if endkey == nil {
-		endkey = params["end_key"]
-	}
+	startkey, endkey := extractRangeKeys(params)
 	inclusiveEnd := true
-	if key := params["key"]; key != nil {
-		startkey = key
-		endkey = key
-	} else {
+	if params["key"] == nil {
 		if value, ok := params["inclusive_end"].(bool); ok {
 			inclusiveEnd = value
 		}
@@ -295,26 +420,63 @@ func ProcessViewResult(result ViewResult, params map[string]interface{},
 
 	var collator JSONCollator
 
-	if startkey != nil {
-		i := sort.Search(len(result.Rows), func(i int) bool {
-			return collator.Collate(result.Rows[i].Key, startkey) >= 0
-		})
-		result.Rows = result.Rows[i:]
-	}
+	if keys, found := params["keys"].([]interface{}); found {
+		// "keys" is a multi-get: fetch each key's matching rows (an exact
+		// match, same as the single "key" param) and concatenate them in
+		// the order the keys were given, ignoring startkey/endkey/reverse.
+		result.Rows = rowsForKeys(result.Rows, keys, &collator)
+	} else if reverse {
+		// Descending queries walk the sorted rows back-to-front, so
+		// startkey/endkey swap roles: startkey becomes the upper bound and
+		// endkey becomes the lower bound.
+		result.Rows = reverseRows(result.Rows)
+
+		if startkey != nil {
+			i := sort.Search(len(result.Rows), func(i int) bool {
+				return collator.Collate(result.Rows[i].Key, startkey) <= 0
+			})
+			result.Rows = result.Rows[i:]
+		}
 
-	if limit > 0 && len(result.Rows) > limit {
-		result.Rows = result.Rows[:limit]
+		if endkey != nil {
+			boundary := 0
+			if !inclusiveEnd {
+				boundary = 1
+			}
+			i := sort.Search(len(result.Rows), func(i int) bool {
+				return collator.Collate(result.Rows[i].Key, endkey) < boundary
+			})
+			result.Rows = result.Rows[:i]
+		}
+	} else {
+		if startkey != nil {
+			i := sort.Search(len(result.Rows), func(i int) bool {
+				return collator.Collate(result.Rows[i].Key, startkey) >= 0
+			})
+			result.Rows = result.Rows[i:]
+		}
+
+		if endkey != nil {
+			boundary := 0
+			if !inclusiveEnd {
+				boundary = -1
+			}
+			i := sort.Search(len(result.Rows), func(i int) bool {
+				return collator.Collate(result.Rows[i].Key, endkey) > boundary
+			})
+			result.Rows = result.Rows[:i]
+		}
 	}
 
-	if endkey != nil {
-		limit := 0
-		if !inclusiveEnd {
-			limit = -1
+	if skip > 0 {
+		if skip > len(result.Rows) {
+			skip = len(result.Rows)
 		}
-		i := sort.Search(len(result.Rows), func(i int) bool {
-			return collator.Collate(result.Rows[i].Key, endkey) > limit
-		})
-		result.Rows = result.Rows[:i]
+		result.Rows = result.Rows[skip:]
+	}
+
+	if limit > 0 && len(result.Rows) > limit {
+		result.Rows = result.Rows[:limit]
 	}
 
 	if includeDocs {
@@ -334,7 +496,16 @@ func ProcessViewResult(result ViewResult, params map[string]interface{},
 	}
 
 	if reduce && reduceFunction != "" {
-		if err := ReduceViewResult(reduceFunction, &result); err != nil {
+		group := false
+		groupLevel := 0
+		if params != nil {
+			group, _ = params["group"].(bool)
+			if level, found := params["group_level"].(int); found {
+				groupLevel = level
+				group = true
+			}
+		}
+		if err := reduceViewResult(reduceFunction, compiledReduce, &result, group, groupLevel); err != nil {
 			return result, err
 		}
 	}
@@ -344,15 +515,33 @@ func ProcessViewResult(result ViewResult, params map[string]interface{},
 	return result, nil
 }
 
-func ReduceViewResult(reduceFunction string, result *ViewResult) error {
-	switch reduceFunction {
-	case "_count":
-		result.Rows = []*ViewRow{{Value: float64(len(result.Rows))}}
-		return nil
-	default:
-		// TODO: Implement other reduce functions!
-		return fmt.Errorf("Walrus only supports _count reduce function")
+// rowsForKeys implements the "keys" query param: a multi-get that returns,
+// for each key in turn, all rows whose Key exactly matches it (the same
+// match "key" alone would give), concatenated in the order the keys were
+// given rather than in collation order. rows must already be sorted by
+// collator, as processViewResult's own index is.
+func rowsForKeys(rows []*ViewRow, keys []interface{}, collator *JSONCollator) []*ViewRow {
+	var matched []*ViewRow
+	for _, key := range keys {
+		lo := sort.Search(len(rows), func(i int) bool {
+			return collator.Collate(rows[i].Key, key) >= 0
+		})
+		hi := sort.Search(len(rows), func(i int) bool {
+			return collator.Collate(rows[i].Key, key) > 0
+		})
+		matched = append(matched, rows[lo:hi]...)
+	}
+	return matched
+}
+
+// Returns a new slice with rows in the opposite order, leaving the input
+// (and the collator's sorted index) untouched.
+func reverseRows(rows []*ViewRow) []*ViewRow {
+	reversed := make([]*ViewRow, len(rows))
+	for i, row := range rows {
+		reversed[len(rows)-1-i] = row
 	}
+	return reversed
 }
 
 //////// VIEW RESULT: (implementation of sort.Interface interface)
@@ -0,0 +1,95 @@
+package walrus
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// sortedRows builds a ViewResult whose Rows are already in ascending
+// collation order, the invariant processViewResult expects of its input
+// (the same invariant updateView maintains via sort.Sort on the live index).
+func sortedRows(keys ...interface{}) ViewResult {
+	result := ViewResult{}
+	for i, key := range keys {
+		result.Rows = append(result.Rows, &ViewRow{ID: string(rune('a' + i)), Key: key})
+	}
+	sort.Sort(&result)
+	return result
+}
+
+func rowKeysOnly(rows []*ViewRow) []interface{} {
+	keys := make([]interface{}, len(rows))
+	for i, row := range rows {
+		keys[i] = row.Key
+	}
+	return keys
+}
+
+// Descending (reverse=true) range queries should return rows from startkey
+// down to endkey, in descending order -- not an empty result, which is what
+// naively feeding startkey/endkey straight into an ascending range would give.
+func TestProcessViewResultDescendingRange(t *testing.T) {
+	result := sortedRows(1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0)
+
+	params := map[string]interface{}{
+		"reverse":  true,
+		"startkey": 8.0,
+		"endkey":   3.0,
+	}
+	out, err := ProcessViewResult(result, params, nil, "")
+	if err != nil {
+		t.Fatalf("ProcessViewResult: %v", err)
+	}
+	expected := []interface{}{8.0, 7.0, 6.0, 5.0, 4.0, 3.0}
+	if got := rowKeysOnly(out.Rows); !reflect.DeepEqual(got, expected) {
+		t.Errorf("descending range = %v, want %v", got, expected)
+	}
+}
+
+// skip and limit should paginate the (already range-filtered) rows, not just
+// truncate from one end -- skip=2,limit=3 over keys 1..10 should land on the
+// third through fifth rows, not the first three or the tail.
+func TestProcessViewResultSkipLimitPagination(t *testing.T) {
+	result := sortedRows(1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0)
+
+	params := map[string]interface{}{
+		"skip":  2,
+		"limit": 3,
+	}
+	out, err := ProcessViewResult(result, params, nil, "")
+	if err != nil {
+		t.Fatalf("ProcessViewResult: %v", err)
+	}
+	expected := []interface{}{3.0, 4.0, 5.0}
+	if got := rowKeysOnly(out.Rows); !reflect.DeepEqual(got, expected) {
+		t.Errorf("skip+limit = %v, want %v", got, expected)
+	}
+	if out.TotalRows != 3 {
+		t.Errorf("TotalRows = %d, want 3", out.TotalRows)
+	}
+}
+
+// Descending range queries must collate compound (array) keys the same way
+// as scalar ones: ["b",1] sorts after ["a",2] ascending, so a reverse query
+// from ["b",1] down to ["a",1] should return all three keys, newest-first.
+func TestProcessViewResultReverseCompoundKeys(t *testing.T) {
+	keyA1 := []interface{}{"a", 1.0}
+	keyA2 := []interface{}{"a", 2.0}
+	keyB1 := []interface{}{"b", 1.0}
+	result := sortedRows(keyA1, keyA2, keyB1)
+
+	params := map[string]interface{}{
+		"reverse":  true,
+		"startkey": keyB1,
+		"endkey":   keyA1,
+	}
+	out, err := ProcessViewResult(result, params, nil, "")
+	if err != nil {
+		t.Fatalf("ProcessViewResult: %v", err)
+	}
+	expected := []interface{}{keyB1, keyA2, keyA1}
+	if got := rowKeysOnly(out.Rows); !reflect.DeepEqual(got, expected) {
+		t.Errorf("reverse compound-key range = %v, want %v", got, expected)
+	}
+}